@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/filipecabaco/pglite/elixir-pglite-bridge/pglite_port/pgerror"
+)
+
+// Frame wire format.
+//
+// Incoming (Elixir -> Go):   <4 byte length><4 byte request_id><payload>
+// Outgoing (Go -> Elixir):   <4 byte length><4 byte request_id><payload>
+//
+// The length covers only the payload, mirroring the original writeResponse
+// framing so existing length accounting on the Elixir side keeps working;
+// the request_id lets multiple outstanding queries be pipelined over the
+// same stdin/stdout pair and correlated on the way back.
+const frameHeaderSize = 8 // 4 bytes length + 4 bytes request_id
+
+// errFrameTooLarge is returned by readFrame when a frame's declared length
+// exceeds maxBufferSize. requestID is still valid on this error (readFrame
+// drains and discards the oversized payload itself, in bounded chunks, so
+// the stream stays framed), letting the caller reply to that specific
+// request instead of tearing down the whole connection.
+var errFrameTooLarge = errors.New("frame exceeds maximum buffer size")
+
+// readFrame reads one length-prefixed, request-tagged frame from r.
+func readFrame(r io.Reader) (requestID uint32, payload []byte, err error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:4])
+	requestID = binary.BigEndian.Uint32(header[4:])
+
+	if length > maxBufferSize {
+		// Discard in bounded chunks rather than allocating the declared
+		// length up front, so a corrupted or malicious length field can't
+		// force a multi-GB allocation before we even get to reject it.
+		if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+			return requestID, nil, err
+		}
+		return requestID, nil, errFrameTooLarge
+	}
+
+	payload = make([]byte, length)
+	if length > 0 {
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return requestID, payload, nil
+}
+
+// writeResponse writes a tagged response to w in the format Elixir expects:
+// <4 byte length><4 byte request_id><payload>. Safe for concurrent callers.
+func writeResponse(w io.Writer, mu *sync.Mutex, requestID uint32, data []byte) error {
+	header := make([]byte, frameHeaderSize)
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(header[4:], requestID)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if f, ok := w.(*os.File); ok {
+		return f.Sync()
+	}
+	return nil
+}
+
+// defaultWorkerCount is the number of goroutines concurrently executing
+// frames and writing their responses when PGLITE_WORKERS is unset; frames
+// are read by a single loop in runWorkerPool.
+const defaultWorkerCount = 4
+
+// workerCountFromEnv reads PGLITE_WORKERS, falling back to defaultWorkerCount.
+func workerCountFromEnv() int {
+	raw := os.Getenv("PGLITE_WORKERS")
+	if raw == "" {
+		return defaultWorkerCount
+	}
+
+	var count int
+	if _, err := fmt.Sscanf(raw, "%d", &count); err != nil || count <= 0 {
+		log.Printf("Warning: Invalid PGLITE_WORKERS '%s', using %d", raw, defaultWorkerCount)
+		return defaultWorkerCount
+	}
+
+	return count
+}
+
+// pendingFrame is a frame read from stdin awaiting execution.
+type pendingFrame struct {
+	requestID uint32
+	payload   []byte
+}
+
+// runWorkerPool reads frames from r and fans them out across a pool of
+// goroutines that each call instance.ExecProtocolRaw and write the tagged
+// response to w. ExecProtocolRaw serializes on the instance's own mutex, so
+// the pool overlaps frame I/O and dispatch with in-flight execution rather
+// than running queries in parallel.
+func runWorkerPool(r io.Reader, w io.Writer, instance *PGliteInstance, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	frames := make(chan pendingFrame)
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for frame := range frames {
+				if len(frame.payload) == 0 {
+					continue
+				}
+
+				response, err := instance.ExecProtocolRaw(frame.payload)
+				if err != nil {
+					classified := pgerror.ClassifyWASMError(err)
+					log.Printf("Error executing protocol (request_id=%d): %v", frame.requestID, classified)
+					response = pgerror.BuildErrorResponse(classified)
+				}
+
+				if err := writeResponse(w, &writeMu, frame.requestID, response); err != nil {
+					log.Printf("Error writing response (request_id=%d): %v", frame.requestID, err)
+				}
+			}
+		}()
+	}
+
+	var readErr error
+	for {
+		requestID, payload, err := readFrame(r)
+		if err != nil {
+			if errors.Is(err, errFrameTooLarge) {
+				log.Printf("Rejecting oversized frame (request_id=%d, max=%d bytes)", requestID, maxBufferSize)
+				response := pgerror.BuildErrorResponse(fmt.Errorf("frame exceeds %d byte limit", maxBufferSize))
+				if err := writeResponse(w, &writeMu, requestID, response); err != nil {
+					log.Printf("Error writing response (request_id=%d): %v", requestID, err)
+				}
+				continue
+			}
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+
+		if len(payload) == 0 {
+			continue
+		}
+
+		frames <- pendingFrame{requestID: requestID, payload: payload}
+	}
+
+	close(frames)
+	wg.Wait()
+
+	return readErr
+}
@@ -1,19 +1,23 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"encoding/binary"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
 	"github.com/tetratelabs/wazero/imports/emscripten"
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+
+	"github.com/filipecabaco/pglite/elixir-pglite-bridge/pglite_port/pgerror"
+	"github.com/filipecabaco/pglite/elixir-pglite-bridge/pglite_port/server"
 )
 
 // PGliteInstance manages a single PGlite WASM instance
@@ -23,6 +27,16 @@ type PGliteInstance struct {
 	memory  api.Memory
 	ctx     context.Context
 
+	// ownsRuntime is true when this instance compiled its own runtime and
+	// should close it; pooled instances share a runtime owned by the Pool
+	// and only close their own module on Close.
+	ownsRuntime bool
+
+	// wasmBytes and pgdataHostPath are retained so Snapshot can stamp a
+	// wasm-build hash and tar up the mounted data directory; see snapshot.go.
+	wasmBytes      []byte
+	pgdataHostPath string
+
 	// Buffers for WASM communication (mirrors TypeScript implementation)
 	outputData   []byte // Data to send to WASM
 	inputData    []byte // Data received from WASM
@@ -31,6 +45,23 @@ type PGliteInstance struct {
 	keepRawResp  bool
 
 	mu sync.Mutex
+
+	// lastUsedUnixNano is updated after every completed ExecProtocolRaw
+	// call (Unix nanoseconds), not just on acquisition from the Pool, so
+	// Pool.evictIdle can tell a genuinely idle instance apart from one a
+	// caller has been holding onto and actively querying for the whole
+	// process lifetime (the stdin bridge) or an entire connection (the
+	// TCP listener). Accessed via LastUsed/touchLastUsed without inst.mu,
+	// since eviction reads it from outside any in-flight call.
+	lastUsedUnixNano atomic.Int64
+
+	// closed is set by Close, under inst.mu, before tearing the module
+	// down. ExecProtocolRaw checks it first (also under inst.mu) so a call
+	// racing a Pool eviction's Close gets a classified pgerror.ErrModuleClosed
+	// instead of an inconsistent error straight from the closed wazero
+	// module, letting callers (see server.relayMessages) distinguish
+	// "resolve a fresh instance and retry" from a real execution failure.
+	closed atomic.Bool
 }
 
 const (
@@ -43,25 +74,125 @@ const (
 	memoryProtocol     = "memory://"      // Protocol prefix for in-memory storage
 	fileProtocol       = "file://"        // Protocol prefix for file storage
 	defaultDirPerms    = 0755             // Default directory permissions
+
+	// pgVersionFile is the marker file PostgreSQL's initdb writes into the
+	// data directory; its contents identify the major version the cluster
+	// was created with.
+	pgVersionFile = "PG_VERSION"
+
+	// bakedPGMajorVersion is the PostgreSQL major version baked into
+	// pglite.wasm. A persisted data directory whose PG_VERSION doesn't
+	// match this is refused rather than risk running a mismatched cluster.
+	bakedPGMajorVersion = "17"
+)
+
+// Persistence controls how NewPGliteInstance treats config.DataDir.
+type Persistence int
+
+const (
+	// PersistenceEphemeral always bootstraps a fresh cluster, ignoring
+	// anything already on disk at DataDir. This is the historical behavior.
+	PersistenceEphemeral Persistence = iota
+	// PersistenceInitIfEmpty reuses an existing, version-matching cluster at
+	// DataDir, or bootstraps a new one if DataDir is empty or missing.
+	PersistenceInitIfEmpty
+	// PersistenceRequireExisting refuses to start unless DataDir already
+	// holds a version-matching cluster.
+	PersistenceRequireExisting
 )
 
+// parsePersistence parses PGLITE_PERSISTENCE, defaulting to
+// PersistenceEphemeral to preserve historical behavior.
+func parsePersistence(raw string) Persistence {
+	switch raw {
+	case "", "ephemeral":
+		return PersistenceEphemeral
+	case "init_if_empty":
+		return PersistenceInitIfEmpty
+	case "require_existing":
+		return PersistenceRequireExisting
+	default:
+		log.Printf("Warning: Invalid PGLITE_PERSISTENCE '%s', using ephemeral", raw)
+		return PersistenceEphemeral
+	}
+}
+
+// parseListenAuth parses PGLITE_LISTEN_AUTH, defaulting to AuthTrust. "md5"
+// and "scram" are accepted here (so operators can opt in once they're
+// implemented) even though server.authenticate currently rejects both.
+func parseListenAuth(raw string) server.AuthMode {
+	switch raw {
+	case "", "trust":
+		return server.AuthTrust
+	case "md5":
+		return server.AuthMD5
+	case "scram":
+		return server.AuthSCRAM
+	default:
+		log.Printf("Warning: Invalid PGLITE_LISTEN_AUTH '%s', using trust", raw)
+		return server.AuthTrust
+	}
+}
+
+// String renders a Persistence value for logging.
+func (p Persistence) String() string {
+	switch p {
+	case PersistenceInitIfEmpty:
+		return "init_if_empty"
+	case PersistenceRequireExisting:
+		return "require_existing"
+	default:
+		return "ephemeral"
+	}
+}
+
 // Config holds PGlite configuration from environment variables
 type Config struct {
-	WASMPath string
-	DataDir  string
-	Username string
-	Database string
-	Debug    int
+	WASMPath    string
+	DataDir     string
+	Username    string
+	Database    string
+	Debug       int
+	Persistence Persistence
+	// ListenAddr, when non-empty, starts a PostgreSQL wire-protocol TCP
+	// listener (see package server) alongside the stdin loop.
+	ListenAddr string
+	// ListenAuth selects the TCP listener's auth mode; see parseListenAuth.
+	ListenAuth server.AuthMode
+	// ListenPassword is passed to the listener for ListenAuth modes other
+	// than trust; the listener rejects those modes and does not read it.
+	ListenPassword string
+	// PoolIdleTTL is how long a per-tenant instance (see Pool) may sit
+	// unused before it's evicted. <= 0 disables eviction. An evicted
+	// instance's TCP connection(s) transparently re-resolve and retry on
+	// their next query (see server.relayMessages); the stdin bridge's
+	// primary instance does not, since runWorkerPool holds its instance
+	// handle directly for the process lifetime rather than through a
+	// resolver, so setting this for a single-tenant stdin deployment would
+	// break it once it sits idle longer than the TTL. It's intended for multi-tenant pools
+	// fronted by the TCP listener, not the default stdin-only setup.
+	PoolIdleTTL time.Duration
+	// SnapshotOnExit, when true, writes a snapshot of the primary instance
+	// to SnapshotPath before the process exits. See snapshot.go.
+	SnapshotOnExit bool
+	SnapshotPath   string
 }
 
 // readConfig reads configuration from environment variables with sensible defaults
 func readConfig() *Config {
 	config := &Config{
-		WASMPath: getEnvOrDefault("PGLITE_WASM_PATH", "../priv/pglite/pglite.wasm"),
-		DataDir:  getEnvOrDefault("PGLITE_DATA_DIR", memoryProtocol),
-		Username: getEnvOrDefault("PGLITE_USERNAME", "postgres"),
-		Database: getEnvOrDefault("PGLITE_DATABASE", "postgres"),
-		Debug:    parseDebugLevel(os.Getenv("PGLITE_DEBUG")),
+		WASMPath:       getEnvOrDefault("PGLITE_WASM_PATH", "../priv/pglite/pglite.wasm"),
+		DataDir:        getEnvOrDefault("PGLITE_DATA_DIR", memoryProtocol),
+		Username:       getEnvOrDefault("PGLITE_USERNAME", "postgres"),
+		Database:       getEnvOrDefault("PGLITE_DATABASE", "postgres"),
+		Debug:          parseDebugLevel(os.Getenv("PGLITE_DEBUG")),
+		Persistence:    parsePersistence(os.Getenv("PGLITE_PERSISTENCE")),
+		ListenAddr:     os.Getenv("PGLITE_LISTEN_ADDR"),
+		ListenAuth:     parseListenAuth(os.Getenv("PGLITE_LISTEN_AUTH")),
+		ListenPassword: os.Getenv("PGLITE_LISTEN_PASSWORD"),
+		PoolIdleTTL:    parseDurationSeconds(os.Getenv("PGLITE_POOL_IDLE_TTL_SECONDS"), 0),
+		SnapshotOnExit: parseBoolEnv(os.Getenv("PGLITE_SNAPSHOT_ON_EXIT")),
+		SnapshotPath:   getEnvOrDefault("PGLITE_SNAPSHOT_PATH", "pglite.snapshot"),
 	}
 
 	return config
@@ -98,6 +229,28 @@ func parseDebugLevel(debugStr string) int {
 	return level
 }
 
+// parseBoolEnv parses a "1"/"true" style boolean environment value,
+// defaulting to false for anything else including an empty string.
+func parseBoolEnv(raw string) bool {
+	return raw == "1" || strings.EqualFold(raw, "true")
+}
+
+// parseDurationSeconds parses a whole number of seconds, falling back to
+// defaultValue if raw is empty or invalid.
+func parseDurationSeconds(raw string, defaultValue time.Duration) time.Duration {
+	if raw == "" {
+		return defaultValue
+	}
+
+	var seconds int
+	if _, err := fmt.Sscanf(raw, "%d", &seconds); err != nil || seconds < 0 {
+		log.Printf("Warning: Invalid duration '%s', using %s", raw, defaultValue)
+		return defaultValue
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
 // log prints the configuration (for debugging)
 func (c *Config) log() {
 	log.Printf("Configuration:")
@@ -106,6 +259,17 @@ func (c *Config) log() {
 	log.Printf("  Username:  %s", c.Username)
 	log.Printf("  Database:  %s", c.Database)
 	log.Printf("  Debug:     %d", c.Debug)
+	log.Printf("  Persistence: %s", c.Persistence)
+	if c.ListenAddr != "" {
+		log.Printf("  Listen Addr: %s", c.ListenAddr)
+		log.Printf("  Listen Auth: %d", c.ListenAuth)
+	}
+	if c.PoolIdleTTL > 0 {
+		log.Printf("  Pool idle TTL: %s", c.PoolIdleTTL)
+	}
+	if c.SnapshotOnExit {
+		log.Printf("  Snapshot on exit: %s", c.SnapshotPath)
+	}
 }
 
 // configureFilesystem sets up filesystem mounting for the WASM module.
@@ -114,28 +278,30 @@ func (c *Config) log() {
 //   - File-based: dataDir is a path - mounts host directory to WASM filesystem
 //
 // File paths can use "file://" prefix or be plain paths (relative or absolute).
-func configureFilesystem(moduleConfig wazero.ModuleConfig, dataDir string) error {
+// Returns the (possibly updated) moduleConfig and the resolved host path, or
+// "" for in-memory mode.
+func configureFilesystem(moduleConfig wazero.ModuleConfig, dataDir string) (wazero.ModuleConfig, string, error) {
 	// Check if using in-memory mode
 	if isMemoryMode(dataDir) {
 		log.Printf("Filesystem mode: in-memory (ephemeral - data will not persist)")
-		return nil
+		return moduleConfig, "", nil
 	}
 
 	// Extract and validate the host path
 	hostPath, err := extractHostPath(dataDir)
 	if err != nil {
-		return fmt.Errorf("invalid data directory configuration: %w", err)
+		return moduleConfig, "", fmt.Errorf("invalid data directory configuration: %w", err)
 	}
 
 	// Expand to absolute path for clarity and reliability
 	absPath, err := filepath.Abs(hostPath)
 	if err != nil {
-		return fmt.Errorf("failed to resolve path '%s' to absolute path: %w", hostPath, err)
+		return moduleConfig, "", fmt.Errorf("failed to resolve path '%s' to absolute path: %w", hostPath, err)
 	}
 
 	// Create directory structure if it doesn't exist
 	if err := os.MkdirAll(absPath, defaultDirPerms); err != nil {
-		return fmt.Errorf("failed to create data directory '%s': %w", absPath, err)
+		return moduleConfig, "", fmt.Errorf("failed to create data directory '%s': %w", absPath, err)
 	}
 
 	log.Printf("Filesystem mode: persistent")
@@ -144,12 +310,12 @@ func configureFilesystem(moduleConfig wazero.ModuleConfig, dataDir string) error
 
 	// Mount the host directory into the WASM filesystem using wazero's FSConfig
 	// The WASM module will see this as wasmDataMountPoint (/pgdata)
-	moduleConfig.WithFSConfig(wazero.NewFSConfig().
+	moduleConfig = moduleConfig.WithFSConfig(wazero.NewFSConfig().
 		WithDirMount(absPath, wasmDataMountPoint))
 
 	log.Printf("File persistence enabled successfully")
 
-	return nil
+	return moduleConfig, absPath, nil
 }
 
 // isMemoryMode checks if the data directory indicates in-memory mode
@@ -195,86 +361,118 @@ func main() {
 
 	log.Printf("WASM file loaded: %d bytes", len(wasmBytes))
 
-	// Create PGlite instance
-	instance, err := NewPGliteInstance(context.Background(), wasmBytes, config)
-	if err != nil {
-		log.Fatalf("Failed to create PGlite instance: %v", err)
-	}
-	defer instance.Close()
+	ctx := context.Background()
 
-	log.Println("PGlite instance initialized successfully")
-	log.Println("Ready to accept protocol messages on stdin")
+	// `pglite_port snapshot [output-path]` produces a reusable snapshot file
+	// from a single instance and exits, instead of running the bridge.
+	if len(os.Args) > 1 && os.Args[1] == "snapshot" {
+		runSnapshotCLI(ctx, wasmBytes, config, os.Args[2:])
+		return
+	}
 
-	// Main loop: read from stdin, process, write to stdout
-	scanner := bufio.NewScanner(os.Stdin)
-	scanner.Buffer(make([]byte, 4*1024*1024), 4*1024*1024) // 4MB buffer
+	// Compile the WASM module once and instantiate per-tenant instances
+	// from it on demand. The stdin bridge is single-tenant by construction
+	// (it speaks for one Elixir port), so it always resolves config.Database;
+	// the TCP listener resolves a tenant per connection from the startup
+	// packet's database parameter, which is what lets one process serve
+	// multiple databases.
+	pool, err := NewPool(ctx, wasmBytes, *config, config.PoolIdleTTL)
+	if err != nil {
+		log.Fatalf("Failed to create instance pool: %v", err)
+	}
+	defer pool.Close(ctx)
 
-	for scanner.Scan() {
-		message := scanner.Bytes()
+	instance, err := pool.Get(ctx, config.Database)
+	if err != nil {
+		log.Fatalf("Failed to create PGlite instance: %v", err)
+	}
 
-		if len(message) == 0 {
-			continue
-		}
+	if config.SnapshotOnExit {
+		// Deferred after pool.Close above, so it runs first: the snapshot
+		// is taken while the instance is still alive.
+		defer snapshotOnExit(instance, config.SnapshotPath)
+	}
 
-		// Execute protocol message
-		response, err := instance.ExecProtocolRaw(message)
-		if err != nil {
-			log.Printf("Error executing protocol: %v", err)
-			// Send error response to Elixir
-			writeResponse([]byte(fmt.Sprintf("ERROR: %v", err)))
-			continue
-		}
+	log.Println("PGlite instance initialized successfully")
 
-		// Send response back to Elixir
-		writeResponse(response)
+	// The TCP listener and the stdin loop coexist: both drive instances out
+	// of the same Pool, whose instances each serialize on their own
+	// mutex, so a psql/pgx connection and the Elixir port never race
+	// against the same WASM module, only interleave.
+	if config.ListenAddr != "" {
+		go func() {
+			serverConfig := server.Config{ListenAddr: config.ListenAddr, Auth: config.ListenAuth, Password: config.ListenPassword}
+			if err := server.Serve(serverConfig, poolResolver{ctx: ctx, pool: pool}); err != nil {
+				log.Printf("server: stopped: %v", err)
+			}
+		}()
 	}
 
-	if err := scanner.Err(); err != nil {
+	log.Println("Ready to accept protocol messages on stdin")
+
+	// Run the frame worker pool: read length-prefixed, request-tagged frames
+	// from stdin and dispatch them concurrently, writing tagged responses
+	// back to stdout. ExecProtocolRaw serializes on inst.mu, so concurrency
+	// here buys pipelining of outstanding requests rather than parallel
+	// execution.
+	if err := runWorkerPool(os.Stdin, os.Stdout, instance, workerCountFromEnv()); err != nil {
 		log.Fatalf("Error reading stdin: %v", err)
 	}
 }
 
-// NewPGliteInstance creates a new PGlite WASM instance
+// NewPGliteInstance creates a new PGlite WASM instance with its own
+// dedicated runtime. Callers managing many instances (see Pool) should
+// instead compile the module once and call newInstanceFromCompiled so the
+// compiled module is shared.
 func NewPGliteInstance(ctx context.Context, wasmBytes []byte, config *Config) (*PGliteInstance, error) {
-	inst := &PGliteInstance{
-		ctx:         ctx,
-		inputData:   make([]byte, defaultRecvBufSize),
-		outputData:  make([]byte, 0),
-		keepRawResp: true,
-	}
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig())
 
-	// Create runtime
-	runtimeConfig := wazero.NewRuntimeConfig()
-	inst.runtime = wazero.NewRuntimeWithConfig(ctx, runtimeConfig)
-
-	// Instantiate WASI
-	if _, err := wasi_snapshot_preview1.Instantiate(ctx, inst.runtime); err != nil {
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
 		return nil, fmt.Errorf("failed to instantiate WASI: %w", err)
 	}
-
-	// Instantiate Emscripten functions
-	if _, err := emscripten.Instantiate(ctx, inst.runtime); err != nil {
+	if _, err := emscripten.Instantiate(ctx, runtime); err != nil {
 		return nil, fmt.Errorf("failed to instantiate Emscripten: %w", err)
 	}
 
-	// Compile module
-	compiledModule, err := inst.runtime.CompileModule(ctx, wasmBytes)
+	compiledModule, err := runtime.CompileModule(ctx, wasmBytes)
 	if err != nil {
 		return nil, fmt.Errorf("failed to compile module: %w", err)
 	}
 
+	return newInstanceFromCompiled(ctx, runtime, compiledModule, config, "pglite", true, wasmBytes)
+}
+
+// newInstanceFromCompiled instantiates compiledModule on runtime under
+// instanceName and runs it through filesystem configuration and database
+// initialization. ownsRuntime controls whether Close tears down the whole
+// runtime or just this instance's module. wasmBytes is retained only so
+// Snapshot can stamp a build hash; it is not re-compiled here.
+func newInstanceFromCompiled(ctx context.Context, runtime wazero.Runtime, compiledModule wazero.CompiledModule, config *Config, instanceName string, ownsRuntime bool, wasmBytes []byte) (*PGliteInstance, error) {
+	inst := &PGliteInstance{
+		ctx:         ctx,
+		runtime:     runtime,
+		ownsRuntime: ownsRuntime,
+		wasmBytes:   wasmBytes,
+		inputData:   make([]byte, defaultRecvBufSize),
+		outputData:  make([]byte, 0),
+		keepRawResp: true,
+	}
+	inst.touchLastUsed()
+
 	// Configure module with filesystem mounting based on data_dir
 	moduleConfig := wazero.NewModuleConfig().
-		WithName("pglite").
+		WithName(instanceName).
 		WithStdout(os.Stdout).
 		WithStderr(os.Stderr)
 
 	// Handle filesystem configuration based on data_dir
-	if err := configureFilesystem(moduleConfig, config.DataDir); err != nil {
+	moduleConfig, hostPath, err := configureFilesystem(moduleConfig, config.DataDir)
+	if err != nil {
 		return nil, fmt.Errorf("failed to configure filesystem: %w", err)
 	}
+	inst.pgdataHostPath = hostPath
 
-	inst.module, err = inst.runtime.InstantiateModule(ctx, compiledModule, moduleConfig)
+	inst.module, err = runtime.InstantiateModule(ctx, compiledModule, moduleConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to instantiate module: %w", err)
 	}
@@ -288,16 +486,68 @@ func NewPGliteInstance(ctx context.Context, wasmBytes []byte, config *Config) (*
 	log.Printf("WASM memory size: %d bytes", inst.memory.Size())
 
 	// Initialize database
-	if err := inst.initDatabase(); err != nil {
+	if err := inst.initDatabase(hostPath, config.Persistence); err != nil {
 		return nil, fmt.Errorf("failed to initialize database: %w", err)
 	}
 
 	return inst, nil
 }
 
-// initDatabase calls _pgl_initdb and _pgl_backend
+// inspectExistingCluster reports whether hostPath already holds an
+// initialized PostgreSQL cluster and, if so, the major version recorded in
+// its PG_VERSION file. hostPath == "" (in-memory mode) never has an existing
+// cluster.
+func inspectExistingCluster(hostPath string) (exists bool, version string, err error) {
+	if hostPath == "" {
+		return false, "", nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(hostPath, pgVersionFile))
+	if os.IsNotExist(err) {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", fmt.Errorf("failed to read %s: %w", pgVersionFile, err)
+	}
+
+	return true, strings.TrimSpace(string(data)), nil
+}
+
+// initDatabase decides, based on persistence and what (if anything) already
+// exists at hostPath, whether to attach to an existing cluster or bootstrap
+// a new one, then starts the PostgreSQL backend.
+func (inst *PGliteInstance) initDatabase(hostPath string, persistence Persistence) error {
+	exists, version, err := inspectExistingCluster(hostPath)
+	if err != nil {
+		return err
+	}
+
+	switch persistence {
+	case PersistenceRequireExisting:
+		if !exists {
+			return fmt.Errorf("PGLITE_PERSISTENCE=require_existing but no %s found under %s", pgVersionFile, hostPath)
+		}
+	case PersistenceEphemeral:
+		// Historical behavior: always start from a fresh cluster, even if
+		// DataDir happens to be populated.
+		exists = false
+	case PersistenceInitIfEmpty:
+		// exists as computed above is authoritative.
+	}
+
+	if exists {
+		if version != bakedPGMajorVersion {
+			return fmt.Errorf("data directory %s was initialized with PostgreSQL %s, but this build of pglite.wasm is PostgreSQL %s", hostPath, version, bakedPGMajorVersion)
+		}
+		return inst.attachExistingCluster(hostPath)
+	}
+
+	return inst.bootstrapNewCluster(hostPath)
+}
+
+// bootstrapNewCluster calls _pgl_initdb followed by _pgl_backend.
 // This mirrors packages/pglite/src/pglite.ts:476-521
-func (inst *PGliteInstance) initDatabase() error {
+func (inst *PGliteInstance) bootstrapNewCluster(hostPath string) error {
 	log.Println("Initializing PostgreSQL database...")
 
 	// Call _pgl_initdb()
@@ -317,14 +567,26 @@ func (inst *PGliteInstance) initDatabase() error {
 
 	log.Println("Database initialized successfully")
 
-	// Call _pgl_backend()
+	return inst.startBackend()
+}
+
+// attachExistingCluster reuses an already-initialized, version-matching
+// cluster at hostPath, skipping _pgl_initdb entirely.
+func (inst *PGliteInstance) attachExistingCluster(hostPath string) error {
+	log.Printf("Reusing existing PostgreSQL cluster at %s (PG_VERSION matches %s)", hostPath, bakedPGMajorVersion)
+
+	return inst.startBackend()
+}
+
+// startBackend calls _pgl_backend, which is shared by both the bootstrap and
+// attach paths.
+func (inst *PGliteInstance) startBackend() error {
 	backend := inst.module.ExportedFunction("_pgl_backend")
 	if backend == nil {
 		return fmt.Errorf("_pgl_backend function not found")
 	}
 
-	_, err = backend.Call(inst.ctx)
-	if err != nil {
+	if _, err := backend.Call(inst.ctx); err != nil {
 		return fmt.Errorf("_pgl_backend failed: %w", err)
 	}
 
@@ -339,6 +601,10 @@ func (inst *PGliteInstance) ExecProtocolRaw(message []byte) ([]byte, error) {
 	inst.mu.Lock()
 	defer inst.mu.Unlock()
 
+	if inst.closed.Load() {
+		return nil, fmt.Errorf("instance closed: %w", pgerror.ErrModuleClosed)
+	}
+
 	// Reset offsets
 	inst.readOffset = 0
 	inst.writeOffset = 0
@@ -368,6 +634,7 @@ func (inst *PGliteInstance) ExecProtocolRaw(message []byte) ([]byte, error) {
 	}
 
 	_, err := interactiveOne.Call(inst.ctx, msgLength, firstByte)
+	inst.touchLastUsed()
 	if err != nil {
 		return nil, fmt.Errorf("_interactive_one failed: %w", err)
 	}
@@ -385,22 +652,35 @@ func (inst *PGliteInstance) ExecProtocolRaw(message []byte) ([]byte, error) {
 	return []byte{}, nil
 }
 
-// Close closes the WASM instance
-func (inst *PGliteInstance) Close() error {
-	if inst.runtime != nil {
-		return inst.runtime.Close(inst.ctx)
-	}
-	return nil
+// touchLastUsed records that inst was just used, for Pool.evictIdle.
+func (inst *PGliteInstance) touchLastUsed() {
+	inst.lastUsedUnixNano.Store(time.Now().UnixNano())
+}
+
+// LastUsed returns the time of inst's last completed ExecProtocolRaw call
+// (or its creation time, if none have completed yet).
+func (inst *PGliteInstance) LastUsed() time.Time {
+	return time.Unix(0, inst.lastUsedUnixNano.Load())
 }
 
-// writeResponse writes a response to stdout in the format Elixir expects
-// Format: <4 bytes length><data>
-func writeResponse(data []byte) {
-	// Write length prefix (4 bytes, big endian)
-	lengthBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(lengthBuf, uint32(len(data)))
+// Close closes the WASM instance. It takes inst.mu so it can't tear down
+// the module out from under an in-flight ExecProtocolRaw call, which also
+// holds inst.mu for its duration.
+func (inst *PGliteInstance) Close() error {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	inst.closed.Store(true)
 
-	os.Stdout.Write(lengthBuf)
-	os.Stdout.Write(data)
-	os.Stdout.Sync()
+	if inst.ownsRuntime {
+		if inst.runtime != nil {
+			return inst.runtime.Close(inst.ctx)
+		}
+		return nil
+	}
+
+	if inst.module != nil {
+		return inst.module.Close(inst.ctx)
+	}
+	return nil
 }
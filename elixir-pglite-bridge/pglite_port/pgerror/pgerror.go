@@ -0,0 +1,135 @@
+// Package pgerror classifies low-level WASM/filesystem/context errors into
+// coarse categories and renders them as PostgreSQL ErrorResponse messages.
+// It's a separate package, rather than living in package main alongside
+// PGliteInstance, so both the stdin worker pool (framing.go) and the TCP
+// listener (server.go, which cannot import package main) can report the
+// same SQLSTATE for the same underlying failure.
+package pgerror
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// Error categories surfaced to callers. These are deliberately coarse:
+// callers match against them with errors.Is rather than parsing message
+// text, and each maps to a SQLSTATE in SQLStateFor so Postgrex-style
+// clients get a real Postgrex.Error instead of a free-text blob.
+var (
+	// ErrWASMTrap means the WASM module itself trapped or exited
+	// abnormally (wraps wazero's sys.ExitError when available).
+	ErrWASMTrap = errors.New("wasm module trapped")
+	// ErrProtocolTimeout means execution was aborted by context
+	// cancellation/deadline before _interactive_one returned.
+	ErrProtocolTimeout = errors.New("protocol message timed out")
+	// ErrModuleClosed means the call happened after the module/runtime was
+	// closed, e.g. a late message racing a pool eviction.
+	ErrModuleClosed = errors.New("wasm module already closed")
+	// ErrFilesystem means a mounted-filesystem operation backing the WASM
+	// module failed (missing file, permission, etc.).
+	ErrFilesystem = errors.New("filesystem operation failed")
+)
+
+// classifiedError pairs a coarse category with the original cause: Is
+// reports membership in the category (so errors.Is(err, ErrWASMTrap)
+// works), while Unwrap exposes the cause so callers can still errors.As
+// into e.g. *sys.ExitError.
+type classifiedError struct {
+	category error
+	cause    error
+}
+
+func (e *classifiedError) Error() string        { return fmt.Sprintf("%s: %v", e.category, e.cause) }
+func (e *classifiedError) Is(target error) bool { return errors.Is(e.category, target) }
+func (e *classifiedError) Unwrap() error        { return e.cause }
+
+func classify(category, cause error) error {
+	return &classifiedError{category: category, cause: cause}
+}
+
+// ClassifyWASMError inspects err, as returned from a wazero function call
+// or filesystem operation, and wraps it in the most specific category
+// above it can identify. Uncategorized errors are returned unchanged.
+func ClassifyWASMError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) {
+		return classify(ErrWASMTrap, err)
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return classify(ErrProtocolTimeout, err)
+	}
+
+	if errors.Is(err, fs.ErrClosed) {
+		return classify(ErrModuleClosed, err)
+	}
+
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		return classify(ErrFilesystem, err)
+	}
+
+	return err
+}
+
+// SQLStateFor maps an error's category to the SQLSTATE code reported in the
+// ErrorResponse. Uncategorized errors map to the generic internal-error
+// code, XX000.
+func SQLStateFor(err error) string {
+	switch {
+	case errors.Is(err, ErrProtocolTimeout):
+		return "57014" // query_canceled
+	case errors.Is(err, ErrModuleClosed):
+		return "57P01" // admin_shutdown
+	case errors.Is(err, ErrFilesystem):
+		return "58030" // io_error
+	default:
+		return "XX000" // internal_error, covers ErrWASMTrap and anything else
+	}
+}
+
+// Postgres backend message type and field tag bytes used by
+// BuildErrorResponse.
+const (
+	msgErrorResponse = 'E'
+	fieldSeverity    = 'S'
+	fieldSQLState    = 'C'
+	fieldMessage     = 'M'
+	severityError    = "ERROR"
+)
+
+// BuildErrorResponse frames err as a PostgreSQL ErrorResponse ('E') message
+// with Severity, SQLSTATE and Message fields, so clients that speak the
+// wire protocol (including Postgrex on the Elixir side, and psql/pgx over
+// the TCP listener) can raise a structured error instead of parsing free
+// text.
+func BuildErrorResponse(err error) []byte {
+	var body []byte
+	body = append(body, fieldSeverity)
+	body = append(body, severityError...)
+	body = append(body, 0)
+	body = append(body, fieldSQLState)
+	body = append(body, SQLStateFor(err)...)
+	body = append(body, 0)
+	body = append(body, fieldMessage)
+	body = append(body, err.Error()...)
+	body = append(body, 0)
+	body = append(body, 0)
+
+	msg := make([]byte, 0, 5+len(body))
+	msg = append(msg, msgErrorResponse)
+	lengthBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(lengthBuf, uint32(4+len(body)))
+	msg = append(msg, lengthBuf...)
+	msg = append(msg, body...)
+
+	return msg
+}
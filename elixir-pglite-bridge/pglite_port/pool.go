@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/emscripten"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+
+	"github.com/filipecabaco/pglite/elixir-pglite-bridge/pglite_port/server"
+)
+
+// poolResolver adapts Pool to server.InstanceResolver, so the TCP listener
+// can resolve a tenant instance per connection from the startup packet's
+// database parameter.
+type poolResolver struct {
+	ctx  context.Context
+	pool *Pool
+}
+
+func (r poolResolver) Resolve(database string) (server.ProtocolExecutor, error) {
+	return r.pool.Get(r.ctx, database)
+}
+
+// Pool lazily instantiates one PGliteInstance per database/tenant, sharing
+// a single compiled WASM module across all of them. wazero's CompileModule
+// result is immutable and safe to instantiate many times, so compiling once
+// and instantiating N times is both the idiomatic and the fast path.
+type Pool struct {
+	runtime   wazero.Runtime
+	compiled  wazero.CompiledModule
+	wasmBytes []byte
+
+	// baseConfig supplies every field except DataDir and Database, which
+	// are derived per tenant.
+	baseConfig Config
+	idleTTL    time.Duration
+
+	mu        sync.Mutex
+	instances map[string]*PGliteInstance
+}
+
+// tenantDirPattern matches the characters sanitizeTenantDir replaces with
+// '_' when deriving a tenant's data subdirectory: everything except ASCII
+// letters, digits, '_', '.' and '-', to keep the result a safe path component.
+var tenantDirPattern = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// NewPool compiles wasmBytes once and returns a Pool ready to instantiate
+// per-tenant instances under it. idleTTL <= 0 disables idle eviction.
+func NewPool(ctx context.Context, wasmBytes []byte, baseConfig Config, idleTTL time.Duration) (*Pool, error) {
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig())
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		return nil, fmt.Errorf("failed to instantiate WASI: %w", err)
+	}
+	if _, err := emscripten.Instantiate(ctx, runtime); err != nil {
+		return nil, fmt.Errorf("failed to instantiate Emscripten: %w", err)
+	}
+
+	compiled, err := runtime.CompileModule(ctx, wasmBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile module: %w", err)
+	}
+
+	p := &Pool{
+		runtime:    runtime,
+		compiled:   compiled,
+		wasmBytes:  wasmBytes,
+		baseConfig: baseConfig,
+		idleTTL:    idleTTL,
+		instances:  make(map[string]*PGliteInstance),
+	}
+
+	if idleTTL > 0 {
+		go p.evictIdleLoop(ctx)
+	}
+
+	return p, nil
+}
+
+// Get returns the instance for database, instantiating it on first use.
+// database == "" is normalized to the pool's base database.
+func (p *Pool) Get(ctx context.Context, database string) (*PGliteInstance, error) {
+	if database == "" {
+		database = p.baseConfig.Database
+	}
+
+	p.mu.Lock()
+	if instance, ok := p.instances[database]; ok {
+		p.mu.Unlock()
+		return instance, nil
+	}
+	p.mu.Unlock()
+
+	tenantDir := sanitizeTenantDir(database)
+
+	// Instantiation happens outside the map lock since it runs _pgl_initdb
+	// and can be slow; a concurrent duplicate request for the same brand
+	// new tenant instantiates twice and the loser's instance is closed
+	// immediately below. Tenant creation is rare relative to query volume,
+	// so this trades a little duplicate work for simplicity.
+	tenantConfig := p.baseConfig
+	tenantConfig.Database = database
+
+	// In-memory pools never touch the filesystem, so there's no host
+	// directory to derive or isolate: filepath.Join-ing a tenant name onto
+	// "memory://" doesn't produce another in-memory DataDir, it produces a
+	// bogus-looking real path ("memory:/postgres") that isMemoryMode no
+	// longer recognizes, silently turning the default ephemeral deployment
+	// into one that mounts and persists a literal "memory:" directory on
+	// disk. Every tenant already gets its own isolated wazero instance and
+	// linear memory regardless of DataDir, so in-memory mode is left
+	// untouched and shared verbatim across tenants.
+	if !isMemoryMode(p.baseConfig.DataDir) {
+		// Strip any "file://" prefix first, as configureFilesystem does, so
+		// the tenant directory is joined onto the real host path.
+		baseDir, err := extractHostPath(p.baseConfig.DataDir)
+		if err != nil {
+			return nil, fmt.Errorf("pool: refusing tenant %q: %w", database, err)
+		}
+		tenantDataDir, err := resolveTenantDataDir(baseDir, tenantDir)
+		if err != nil {
+			return nil, fmt.Errorf("pool: refusing tenant %q: %w", database, err)
+		}
+		tenantConfig.DataDir = tenantDataDir
+	}
+
+	instance, err := newInstanceFromCompiled(ctx, p.runtime, p.compiled, &tenantConfig, "pglite-"+tenantDir, false, p.wasmBytes)
+	if err != nil {
+		return nil, fmt.Errorf("pool: failed to instantiate tenant %q: %w", database, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if existing, ok := p.instances[database]; ok {
+		instance.Close()
+		return existing, nil
+	}
+	p.instances[database] = instance
+	return instance, nil
+}
+
+// sanitizeTenantDir turns a tenant/database identifier into a safe,
+// filesystem-friendly directory name. It never returns "." or ".." (the
+// empty, "." and ".." cases all fall back to "_default"), since those are
+// the only single-path-component values (tenantDirPattern already replaces
+// '/' with '_', so nested traversal like "../../etc" can't occur) that
+// would otherwise let filepath.Join escape the pool's base data directory.
+func sanitizeTenantDir(database string) string {
+	sanitized := tenantDirPattern.ReplaceAllString(database, "_")
+	if sanitized == "" || sanitized == "." || sanitized == ".." {
+		return "_default"
+	}
+	return sanitized
+}
+
+// resolveTenantDataDir joins tenantDir onto baseDir and verifies the result
+// still lands inside baseDir, the same escape check untarInto (snapshot.go)
+// applies to restored tar entries. sanitizeTenantDir already rules out the
+// known escape values, but this is cheap insurance against baseDir itself
+// containing a symlink or ".." component.
+func resolveTenantDataDir(baseDir, tenantDir string) (string, error) {
+	base := filepath.Clean(baseDir)
+	full := filepath.Join(base, tenantDir)
+	if full != base && !strings.HasPrefix(full, base+string(os.PathSeparator)) {
+		return "", fmt.Errorf("tenant data dir %q escapes pool base dir %q", full, base)
+	}
+	return full, nil
+}
+
+// evictIdleLoop closes and forgets instances idle longer than p.idleTTL.
+func (p *Pool) evictIdleLoop(ctx context.Context) {
+	ticker := time.NewTicker(p.idleTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.evictIdle()
+		}
+	}
+}
+
+// evictIdle closes instances whose LastUsed is older than p.idleTTL.
+// LastUsed reflects the instance's own last completed ExecProtocolRaw call,
+// not when it was last fetched from the pool, so a session that called Get
+// once and has been querying ever since (the stdin bridge's single long
+// call to runWorkerPool, or one TCP connection's relayMessages loop) is
+// correctly seen as active rather than evicted out from under it.
+func (p *Pool) evictIdle() {
+	cutoff := time.Now().Add(-p.idleTTL)
+
+	p.mu.Lock()
+	var toClose []*PGliteInstance
+	for database, instance := range p.instances {
+		if instance.LastUsed().Before(cutoff) {
+			toClose = append(toClose, instance)
+			delete(p.instances, database)
+			log.Printf("pool: evicting idle instance for database %q", database)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, instance := range toClose {
+		if err := instance.Close(); err != nil {
+			log.Printf("pool: error closing evicted instance: %v", err)
+		}
+	}
+}
+
+// InstanceMetrics describes one pooled instance.
+type InstanceMetrics struct {
+	Database    string
+	MemoryBytes uint64
+	LastUsed    time.Time
+}
+
+// PoolMetrics summarizes the pool's current state.
+type PoolMetrics struct {
+	InstanceCount    int
+	TotalMemoryBytes uint64
+	Instances        []InstanceMetrics
+}
+
+// Metrics snapshots per-instance and aggregate resource usage.
+func (p *Pool) Metrics() PoolMetrics {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	metrics := PoolMetrics{InstanceCount: len(p.instances)}
+	for database, instance := range p.instances {
+		var memBytes uint64
+		if instance.memory != nil {
+			memBytes = uint64(instance.memory.Size())
+		}
+		metrics.TotalMemoryBytes += memBytes
+		metrics.Instances = append(metrics.Instances, InstanceMetrics{
+			Database:    database,
+			MemoryBytes: memBytes,
+			LastUsed:    instance.LastUsed(),
+		})
+	}
+
+	return metrics
+}
+
+// Close tears down every pooled instance and the shared runtime.
+func (p *Pool) Close(ctx context.Context) error {
+	p.mu.Lock()
+	for _, instance := range p.instances {
+		instance.Close()
+	}
+	p.instances = make(map[string]*PGliteInstance)
+	p.mu.Unlock()
+
+	return p.runtime.Close(ctx)
+}
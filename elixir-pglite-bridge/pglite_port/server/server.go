@@ -0,0 +1,391 @@
+// Package server exposes a PGliteInstance over a real PostgreSQL v3
+// frontend/backend TCP listener, so ordinary clients such as psql and pgx
+// can connect directly to the Go host instead of going through the Elixir
+// stdin/stdout bridge. It can run alongside the stdin loop: both resolve
+// instances from the same Pool, and each instance funnels through its own
+// internal mutex, so a TCP client and the Elixir port using the same
+// database never execute concurrently against its WASM module, only
+// interleaved.
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	"github.com/filipecabaco/pglite/elixir-pglite-bridge/pglite_port/pgerror"
+)
+
+// ProtocolExecutor is the subset of PGliteInstance the server needs. It's
+// defined here, rather than imported from package main, because package
+// main cannot be imported.
+type ProtocolExecutor interface {
+	ExecProtocolRaw(message []byte) ([]byte, error)
+}
+
+// InstanceResolver maps a connection's requested database to the
+// ProtocolExecutor that should serve it, instantiating one on demand. This
+// lets a single listener front a Pool of per-tenant WASM modules.
+type InstanceResolver interface {
+	Resolve(database string) (ProtocolExecutor, error)
+}
+
+// AuthMode selects how the server authenticates incoming connections.
+type AuthMode int
+
+const (
+	// AuthTrust accepts any StartupMessage without a password exchange.
+	AuthTrust AuthMode = iota
+	// AuthMD5 requires PostgreSQL's legacy MD5 challenge/response.
+	AuthMD5
+	// AuthSCRAM requires SCRAM-SHA-256 (RFC 5802 / PostgreSQL's channel-binding-less profile).
+	AuthSCRAM
+)
+
+// Config configures the TCP listener.
+type Config struct {
+	// ListenAddr is the address to listen on, e.g. ":5432". Empty disables
+	// the listener entirely.
+	ListenAddr string
+	Auth       AuthMode
+	// Password is carried for AuthMD5 and AuthSCRAM; authenticate rejects
+	// both of those modes and does not read it.
+	Password string
+}
+
+const (
+	sslRequestCode    = 80877103
+	gssEncRequestCode = 80877104
+	protocolVersion3  = 196608 // 3.0, encoded as (major<<16 | minor)
+
+	// maxMessageSize bounds the length prefix on both the startup message
+	// and every steady-state message, mirroring the maxSnapshotSegmentSize
+	// pattern in snapshot.go: an unauthenticated client could otherwise
+	// send a length near 0xFFFFFFFF and force a multi-GB allocation per
+	// message, repeatable per connection.
+	maxMessageSize = 1 << 30 // 1GB, matches package main's maxBufferSize
+)
+
+// Postgres backend message type bytes used by the handshake.
+const (
+	msgAuthentication = 'R'
+	msgParameterStat  = 'S'
+	msgBackendKeyData = 'K'
+	msgReadyForQuery  = 'Z'
+	msgErrorResponse  = 'E'
+)
+
+// Serve listens on cfg.ListenAddr and, for every accepted connection, runs
+// the startup/auth handshake, resolves an instance for the requested
+// database via resolver, and relays PostgreSQL wire protocol messages to
+// it. It blocks until the listener fails.
+func Serve(cfg Config, resolver InstanceResolver) error {
+	if cfg.ListenAddr == "" {
+		return fmt.Errorf("server: ListenAddr must not be empty")
+	}
+
+	listener, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("server: failed to listen on %s: %w", cfg.ListenAddr, err)
+	}
+	defer listener.Close()
+
+	log.Printf("server: listening for PostgreSQL wire protocol connections on %s", cfg.ListenAddr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return fmt.Errorf("server: accept failed: %w", err)
+		}
+
+		go func() {
+			defer conn.Close()
+			if err := handleConn(conn, cfg, resolver); err != nil && err != io.EOF {
+				log.Printf("server: connection %s closed: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// handleConn drives one client connection end to end: SSL/GSS negotiation,
+// the real startup packet, authentication, and then the steady-state
+// message relay.
+func handleConn(conn net.Conn, cfg Config, resolver InstanceResolver) error {
+	params, err := negotiateStartup(conn)
+	if err != nil {
+		return fmt.Errorf("startup failed: %w", err)
+	}
+
+	log.Printf("server: connection from %s (user=%s database=%s)", conn.RemoteAddr(), params["user"], params["database"])
+
+	if err := authenticate(conn, cfg); err != nil {
+		writeErrorResponse(conn, "28000", err.Error())
+		return fmt.Errorf("authentication failed: %w", err)
+	}
+
+	database := params["database"]
+	exec, err := resolver.Resolve(database)
+	if err != nil {
+		writeErrorResponse(conn, "3D000", err.Error())
+		return fmt.Errorf("failed to resolve database %q: %w", database, err)
+	}
+
+	if err := sendAuthenticationOk(conn); err != nil {
+		return err
+	}
+	if err := sendReadyForQuery(conn); err != nil {
+		return err
+	}
+
+	return relayMessages(conn, resolver, database, exec)
+}
+
+// negotiateStartup consumes any number of SSLRequest/GSSENCRequest probes
+// (rejecting each with a single 'N' byte, per protocol) and returns the
+// parameter map from the real StartupMessage.
+func negotiateStartup(conn net.Conn) (map[string]string, error) {
+	for {
+		length, body, err := readUnframedMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		if length == 8 {
+			code := binary.BigEndian.Uint32(body)
+			if code == sslRequestCode || code == gssEncRequestCode {
+				if _, err := conn.Write([]byte{'N'}); err != nil {
+					return nil, fmt.Errorf("failed to reject SSL/GSS request: %w", err)
+				}
+				continue
+			}
+		}
+
+		return parseStartupParams(body)
+	}
+}
+
+// readUnframedMessage reads a startup-style message: a 4-byte big-endian
+// length (inclusive of itself) followed by length-4 bytes of body. Unlike
+// steady-state messages, there is no leading message-type byte.
+func readUnframedMessage(conn net.Conn) (length uint32, body []byte, err error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, nil, err
+	}
+
+	length = binary.BigEndian.Uint32(header)
+	if length < 4 {
+		return 0, nil, fmt.Errorf("invalid startup message length %d", length)
+	}
+	if length > maxMessageSize {
+		return 0, nil, fmt.Errorf("startup message length %d exceeds %d byte limit", length, maxMessageSize)
+	}
+
+	body = make([]byte, length-4)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return 0, nil, err
+	}
+
+	return length, body, nil
+}
+
+// parseStartupParams decodes the StartupMessage body: a 4-byte protocol
+// version followed by null-terminated key/value pairs, ending in an extra
+// 0 byte.
+func parseStartupParams(body []byte) (map[string]string, error) {
+	if len(body) < 4 {
+		return nil, fmt.Errorf("startup message too short")
+	}
+
+	version := binary.BigEndian.Uint32(body[:4])
+	if version != protocolVersion3 {
+		return nil, fmt.Errorf("unsupported protocol version %d", version)
+	}
+
+	params := make(map[string]string)
+	rest := body[4:]
+	for len(rest) > 1 {
+		key, after, ok := readCString(rest)
+		if !ok {
+			return nil, fmt.Errorf("malformed startup parameter key")
+		}
+		value, after2, ok := readCString(after)
+		if !ok {
+			return nil, fmt.Errorf("malformed startup parameter value")
+		}
+		params[key] = value
+		rest = after2
+	}
+
+	return params, nil
+}
+
+// readCString splits off a null-terminated string from buf, returning the
+// string and the remainder of buf after the terminator.
+func readCString(buf []byte) (value string, rest []byte, ok bool) {
+	for i, b := range buf {
+		if b == 0 {
+			return string(buf[:i]), buf[i+1:], true
+		}
+	}
+	return "", nil, false
+}
+
+// authenticate performs the configured auth handshake. Only AuthTrust is
+// implemented: MD5 and SCRAM require maintaining per-connection challenge
+// state and verifying against a real credential store, which this
+// WASM-backed server doesn't have, so they're rejected
+// explicitly rather than silently falling back to trust.
+func authenticate(conn net.Conn, cfg Config) error {
+	switch cfg.Auth {
+	case AuthTrust:
+		return nil
+	case AuthMD5:
+		return fmt.Errorf("AuthMD5 is not yet implemented")
+	case AuthSCRAM:
+		return fmt.Errorf("AuthSCRAM is not yet implemented")
+	default:
+		return fmt.Errorf("unknown auth mode %d", cfg.Auth)
+	}
+}
+
+// sendAuthenticationOk writes the AuthenticationOk message (auth type 0).
+func sendAuthenticationOk(conn net.Conn) error {
+	msg := make([]byte, 0, 9)
+	msg = append(msg, msgAuthentication)
+	msg = appendInt32(msg, 8)
+	msg = appendInt32(msg, 0)
+	_, err := conn.Write(msg)
+	return err
+}
+
+// sendReadyForQuery writes BackendKeyData followed by ReadyForQuery('I').
+func sendReadyForQuery(conn net.Conn) error {
+	keyData := make([]byte, 0, 13)
+	keyData = append(keyData, msgBackendKeyData)
+	keyData = appendInt32(keyData, 12)
+	keyData = appendInt32(keyData, 0) // process ID: unused, single-process WASM
+	keyData = appendInt32(keyData, 0) // secret key: cancellation isn't supported
+	if _, err := conn.Write(keyData); err != nil {
+		return err
+	}
+
+	return writeReadyForQuery(conn)
+}
+
+// writeReadyForQuery writes ReadyForQuery('I') on its own, without
+// BackendKeyData, for the steady-state relay: BackendKeyData is only sent
+// once, at startup, not after every query error.
+func writeReadyForQuery(conn net.Conn) error {
+	ready := []byte{msgReadyForQuery, 0, 0, 0, 5, 'I'}
+	_, err := conn.Write(ready)
+	return err
+}
+
+// writeErrorResponse emits a minimal ErrorResponse ('E') so a failed
+// handshake at least surfaces a SQLSTATE-bearing message to the client
+// before the connection is closed.
+func writeErrorResponse(conn net.Conn, sqlState, message string) {
+	var body []byte
+	body = append(body, 'S')
+	body = append(body, "FATAL"...)
+	body = append(body, 0)
+	body = append(body, 'C')
+	body = append(body, sqlState...)
+	body = append(body, 0)
+	body = append(body, 'M')
+	body = append(body, message...)
+	body = append(body, 0)
+	body = append(body, 0)
+
+	msg := make([]byte, 0, 5+len(body))
+	msg = append(msg, msgErrorResponse)
+	msg = appendInt32(msg, int32(4+len(body)))
+	msg = append(msg, body...)
+	conn.Write(msg)
+}
+
+func appendInt32(buf []byte, v int32) []byte {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], uint32(v))
+	return append(buf, tmp[:]...)
+}
+
+// relayMessages reads steady-state wire protocol messages (1 byte type + 4
+// byte length-inclusive-of-self + payload) and forwards each one, verbatim,
+// to exec.ExecProtocolRaw, writing back whatever bytes come out. Reads on a
+// single connection are inherently sequential, so each connection's
+// messages reach ExecProtocolRaw one at a time; PGliteInstance's own mutex
+// then serializes across connections.
+//
+// exec was resolved once at startup, but resolver/database are kept so a
+// message that hits pgerror.ErrModuleClosed (the instance was evicted by
+// PGLITE_POOL_IDLE_TTL_SECONDS mid-connection) can transparently re-resolve
+// a fresh instance and retry once, rather than failing every subsequent
+// query on an otherwise-healthy connection.
+func relayMessages(conn net.Conn, resolver InstanceResolver, database string, exec ProtocolExecutor) error {
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return err
+		}
+
+		msgType := header[0]
+		length := binary.BigEndian.Uint32(header[1:])
+		if length < 4 {
+			return fmt.Errorf("invalid message length %d for type %q", length, msgType)
+		}
+		if length > maxMessageSize {
+			// The oversized length desyncs framing (we don't know where the
+			// next message starts without reading length bytes we just
+			// refused to allocate), so the connection is closed rather than
+			// continued; no ReadyForQuery follows since there's no further
+			// query to be ready for.
+			writeErrorResponse(conn, "54000", fmt.Sprintf("message length %d exceeds %d byte limit", length, maxMessageSize))
+			return fmt.Errorf("message length %d for type %q exceeds %d byte limit", length, msgType, maxMessageSize)
+		}
+
+		payload := make([]byte, length-4)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return err
+		}
+
+		message := append(header, payload...)
+
+		response, err := exec.ExecProtocolRaw(message)
+		if err != nil && errors.Is(err, pgerror.ErrModuleClosed) {
+			exec, err = resolver.Resolve(database)
+			if err == nil {
+				response, err = exec.ExecProtocolRaw(message)
+			}
+		}
+		if err != nil {
+			classified := pgerror.ClassifyWASMError(err)
+			log.Printf("server: error executing protocol: %v", classified)
+			// Severity ERROR, not the handshake's FATAL: the connection
+			// stays open for further queries.
+			conn.Write(pgerror.BuildErrorResponse(classified))
+			// The simple query protocol requires a ReadyForQuery after
+			// every error, or a client driving it (psql, pgx) blocks
+			// forever waiting for one. BackendKeyData isn't resent here;
+			// it's only valid once, at startup.
+			if err := writeReadyForQuery(conn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if len(response) > 0 {
+			if _, err := conn.Write(response); err != nil {
+				return err
+			}
+		}
+
+		if msgType == 'X' {
+			return io.EOF
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/emscripten"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Snapshot blob layout (all integers big-endian):
+//
+//	8 bytes   magic "PGLITESN"
+//	1 byte    format version
+//	32 bytes  sha256 of the wasm build this snapshot was taken against
+//	8 bytes   length of the linear memory segment
+//	8 bytes   length of the pgdata tar segment (0 for in-memory DataDir)
+//	32 bytes  sha256 over (memory segment || tar segment)
+//	...       memory segment
+//	...       tar segment
+//
+// The wasm hash and payload checksum exist so RestoreInstance refuses to
+// load a snapshot taken against a different pglite.wasm build, or one that
+// was truncated/corrupted in transit, rather than booting a silently
+// broken cluster.
+const (
+	snapshotMagic   = "PGLITESN"
+	snapshotVersion = 1
+
+	// maxSnapshotSegmentSize bounds the memory and tar segment lengths read
+	// from a snapshot's header, so a truncated or corrupted length field
+	// can't make readSnapshot attempt a multi-terabyte allocation before
+	// the checksum below ever gets a chance to reject it.
+	maxSnapshotSegmentSize = 16 << 30 // 16 GiB
+)
+
+// Snapshot captures this instance's WASM linear memory together with a tar
+// of its mounted pgdata directory (if any) and writes the resulting blob to
+// w. It enables the "template database" pattern: run initdb + migrations
+// once, snapshot, then RestoreInstance a fresh copy per test in
+// milliseconds instead of re-running _pgl_initdb.
+func (inst *PGliteInstance) Snapshot(w io.Writer) error {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	memBytes, ok := inst.memory.Read(0, inst.memory.Size())
+	if !ok {
+		return fmt.Errorf("failed to read WASM linear memory")
+	}
+
+	var tarBuf bytes.Buffer
+	if inst.pgdataHostPath != "" {
+		if err := tarDirectory(&tarBuf, inst.pgdataHostPath); err != nil {
+			return fmt.Errorf("failed to tar pgdata directory: %w", err)
+		}
+	}
+
+	wasmHash := sha256.Sum256(inst.wasmBytes)
+
+	checksum := sha256.New()
+	checksum.Write(memBytes)
+	checksum.Write(tarBuf.Bytes())
+
+	if _, err := io.WriteString(w, snapshotMagic); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{snapshotVersion}); err != nil {
+		return err
+	}
+	if _, err := w.Write(wasmHash[:]); err != nil {
+		return err
+	}
+	if err := writeUint64(w, uint64(len(memBytes))); err != nil {
+		return err
+	}
+	if err := writeUint64(w, uint64(tarBuf.Len())); err != nil {
+		return err
+	}
+	if _, err := w.Write(checksum.Sum(nil)); err != nil {
+		return err
+	}
+	if _, err := w.Write(memBytes); err != nil {
+		return err
+	}
+	if _, err := w.Write(tarBuf.Bytes()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RestoreInstance reconstitutes a PGliteInstance from a blob written by
+// Snapshot: it instantiates wasmBytes fresh, restores pgdata (if the
+// snapshot has any) under config.DataDir, writes the captured linear memory
+// into the new module, and returns an instance ready to serve
+// ExecProtocolRaw calls directly — _pgl_initdb and _pgl_backend are never
+// invoked, since the restored memory already reflects a running backend.
+func RestoreInstance(ctx context.Context, r io.Reader, wasmBytes []byte, config *Config) (*PGliteInstance, error) {
+	memBytes, tarBytes, err := readSnapshot(r, wasmBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig())
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		return nil, fmt.Errorf("failed to instantiate WASI: %w", err)
+	}
+	if _, err := emscripten.Instantiate(ctx, runtime); err != nil {
+		return nil, fmt.Errorf("failed to instantiate Emscripten: %w", err)
+	}
+
+	compiledModule, err := runtime.CompileModule(ctx, wasmBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile module: %w", err)
+	}
+
+	moduleConfig := wazero.NewModuleConfig().
+		WithName("pglite-restored").
+		WithStdout(os.Stdout).
+		WithStderr(os.Stderr)
+
+	moduleConfig, hostPath, err := configureFilesystem(moduleConfig, config.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure filesystem: %w", err)
+	}
+
+	if len(tarBytes) > 0 {
+		if hostPath == "" {
+			return nil, fmt.Errorf("snapshot contains a pgdata directory but DataDir is in-memory; configure a file-based DataDir to restore it")
+		}
+		if err := untarInto(hostPath, tarBytes); err != nil {
+			return nil, fmt.Errorf("failed to restore pgdata directory: %w", err)
+		}
+	}
+
+	module, err := runtime.InstantiateModule(ctx, compiledModule, moduleConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate module: %w", err)
+	}
+
+	memory := module.Memory()
+	if memory == nil {
+		return nil, fmt.Errorf("module has no exported memory")
+	}
+
+	if err := growMemoryToFit(memory, uint64(len(memBytes))); err != nil {
+		return nil, err
+	}
+
+	if !memory.Write(0, memBytes) {
+		return nil, fmt.Errorf("failed to restore WASM linear memory")
+	}
+
+	log.Printf("Restored PGlite instance from snapshot (memory=%d bytes, pgdata=%d bytes)", len(memBytes), len(tarBytes))
+
+	restored := &PGliteInstance{
+		ctx:            ctx,
+		runtime:        runtime,
+		module:         module,
+		memory:         memory,
+		ownsRuntime:    true,
+		wasmBytes:      wasmBytes,
+		pgdataHostPath: hostPath,
+		inputData:      make([]byte, defaultRecvBufSize),
+		outputData:     make([]byte, 0),
+		keepRawResp:    true,
+	}
+	restored.touchLastUsed()
+
+	return restored, nil
+}
+
+// readSnapshot parses and validates a snapshot blob's header, returning its
+// memory and tar segments.
+func readSnapshot(r io.Reader, wasmBytes []byte) (memBytes, tarBytes []byte, err error) {
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, nil, fmt.Errorf("failed to read snapshot magic: %w", err)
+	}
+	if string(magic) != snapshotMagic {
+		return nil, nil, fmt.Errorf("not a pglite snapshot (bad magic)")
+	}
+
+	versionByte := make([]byte, 1)
+	if _, err := io.ReadFull(r, versionByte); err != nil {
+		return nil, nil, fmt.Errorf("failed to read snapshot version: %w", err)
+	}
+	if versionByte[0] != snapshotVersion {
+		return nil, nil, fmt.Errorf("unsupported snapshot format version %d", versionByte[0])
+	}
+
+	storedWASMHash := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, storedWASMHash); err != nil {
+		return nil, nil, fmt.Errorf("failed to read snapshot wasm hash: %w", err)
+	}
+	wasmHash := sha256.Sum256(wasmBytes)
+	if !bytes.Equal(storedWASMHash, wasmHash[:]) {
+		return nil, nil, fmt.Errorf("snapshot was taken against a different pglite.wasm build; refusing to restore")
+	}
+
+	memSize, err := readUint64(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read memory segment length: %w", err)
+	}
+	tarSize, err := readUint64(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read tar segment length: %w", err)
+	}
+	if memSize > maxSnapshotSegmentSize || tarSize > maxSnapshotSegmentSize {
+		return nil, nil, fmt.Errorf("snapshot segment length exceeds %d bytes; refusing to allocate", maxSnapshotSegmentSize)
+	}
+
+	storedChecksum := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, storedChecksum); err != nil {
+		return nil, nil, fmt.Errorf("failed to read snapshot checksum: %w", err)
+	}
+
+	memBytes = make([]byte, memSize)
+	if _, err := io.ReadFull(r, memBytes); err != nil {
+		return nil, nil, fmt.Errorf("failed to read memory segment: %w", err)
+	}
+	tarBytes = make([]byte, tarSize)
+	if _, err := io.ReadFull(r, tarBytes); err != nil {
+		return nil, nil, fmt.Errorf("failed to read tar segment: %w", err)
+	}
+
+	checksum := sha256.New()
+	checksum.Write(memBytes)
+	checksum.Write(tarBytes)
+	if !bytes.Equal(storedChecksum, checksum.Sum(nil)) {
+		return nil, nil, fmt.Errorf("snapshot checksum mismatch; refusing to restore a corrupted snapshot")
+	}
+
+	return memBytes, tarBytes, nil
+}
+
+// growMemoryToFit grows mem, in whole 64KiB pages, until it's at least
+// wantBytes long.
+func growMemoryToFit(mem interface {
+	Size() uint32
+	Grow(uint32) (uint32, bool)
+}, wantBytes uint64) error {
+	const wasmPageSize = 64 * 1024
+
+	if uint64(mem.Size()) >= wantBytes {
+		return nil
+	}
+
+	deltaBytes := wantBytes - uint64(mem.Size())
+	deltaPages := uint32((deltaBytes + wasmPageSize - 1) / wasmPageSize)
+
+	if _, ok := mem.Grow(deltaPages); !ok {
+		return fmt.Errorf("failed to grow WASM linear memory to fit restored snapshot")
+	}
+
+	return nil
+}
+
+// tarDirectory writes a tar archive of every regular file and directory
+// under root to w, using root-relative paths.
+func tarDirectory(w io.Writer, root string) error {
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relPath)
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(tw, file)
+		return err
+	})
+}
+
+// untarInto extracts a tar archive produced by tarDirectory into root,
+// which must already exist.
+func untarInto(root string, tarBytes []byte) error {
+	root = filepath.Clean(root)
+	tr := tar.NewReader(bytes.NewReader(tarBytes))
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(root, filepath.FromSlash(header.Name))
+		if target != root && !strings.HasPrefix(target, root+string(os.PathSeparator)) {
+			return fmt.Errorf("snapshot: tar entry %q escapes pgdata root", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, defaultDirPerms); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), defaultDirPerms); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(file, tr); err != nil {
+				file.Close()
+				return err
+			}
+			file.Close()
+		}
+	}
+}
+
+func writeUint64(w io.Writer, v uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, v)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readUint64(r io.Reader) (uint64, error) {
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf), nil
+}
+
+// runSnapshotCLI implements `pglite_port snapshot [output-path]`: it boots
+// one instance per the usual config (running initdb if needed), snapshots
+// it, and exits. args is os.Args[2:].
+func runSnapshotCLI(ctx context.Context, wasmBytes []byte, config *Config, args []string) {
+	outputPath := "pglite.snapshot"
+	if len(args) > 0 {
+		outputPath = args[0]
+	}
+
+	instance, err := NewPGliteInstance(ctx, wasmBytes, config)
+	if err != nil {
+		log.Fatalf("snapshot: failed to create instance: %v", err)
+	}
+	defer instance.Close()
+
+	snapshotOnExit(instance, outputPath)
+}
+
+// snapshotOnExit writes instance's snapshot to path, logging rather than
+// failing the process on error since it runs from a defer at shutdown.
+func snapshotOnExit(instance *PGliteInstance, path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		log.Printf("snapshot: failed to create %s: %v", path, err)
+		return
+	}
+	defer file.Close()
+
+	if err := instance.Snapshot(file); err != nil {
+		log.Printf("snapshot: failed to write %s: %v", path, err)
+		return
+	}
+
+	log.Printf("snapshot: wrote %s", path)
+}